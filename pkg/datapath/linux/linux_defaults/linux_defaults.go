@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+// Package linux_defaults holds default values for the Linux datapath.
+package linux_defaults
+
+import "time"
+
+const (
+	// RulePriorityIngress is the priority of the IPv4 rule used to steer
+	// traffic destined to an endpoint's IP into the endpoint-specific
+	// routing table. It is a default: operators that need Cilium's policy
+	// routing to coexist with another user of the same priority band on the
+	// same host (Calico, systemd-networkd, WireGuard/Tailscale) can shift it
+	// via routing.SetRoutingConfig's RulePriorityBase.
+	RulePriorityIngress = 110
+
+	// RulePriorityEgress is the priority of the IPv4 rule used to steer
+	// traffic originating from an endpoint's IP into the endpoint-specific
+	// routing table.
+	RulePriorityEgress = 111
+
+	// RulePriorityIngressV6 is the IPv6 equivalent of RulePriorityIngress.
+	// It lives in its own priority band so that the IPv4 and IPv6 rules for
+	// the same endpoint never collide with one another.
+	RulePriorityIngressV6 = 210
+
+	// RulePriorityEgressV6 is the IPv6 equivalent of RulePriorityEgress.
+	RulePriorityEgressV6 = 211
+
+	// RulePriorityEgressCIDR is the priority of the IPv4 ip rule that
+	// matches an endpoint's ipset-backed CIDR fwmark (IPSetMode). It is
+	// deliberately distinct from RulePriorityEgress: the two rules select
+	// on different attributes (Mark/Mask vs From) but share the same
+	// table, and a delete that only filters on Priority/Table would
+	// otherwise be unable to tell them apart.
+	RulePriorityEgressCIDR = 112
+
+	// RulePriorityEgressCIDRV6 is the IPv6 equivalent of
+	// RulePriorityEgressCIDR.
+	RulePriorityEgressCIDRV6 = 212
+
+	// RouteTableInterfacesOffset is added to an interface's number to
+	// derive the IPv4 routing table used to hold its per-ENI (or
+	// equivalent) default route and CIDRs.
+	RouteTableInterfacesOffset = 100
+
+	// RouteTableInterfacesOffsetIPv6 is the IPv6 equivalent of
+	// RouteTableInterfacesOffset. It is kept in a separate table space so
+	// that dual-stack endpoints never share a table between families.
+	RouteTableInterfacesOffsetIPv6 = 10100
+
+	// RoutingRuleReconcilerRateLimit is the maximum number of reconciliation
+	// passes per second that the linuxrouting rule/route reconciler will run
+	// in response to netlink delete/change notifications, to avoid a tight
+	// loop if an external actor keeps removing our rules and routes.
+	RoutingRuleReconcilerRateLimit = 10
+
+	// RoutingRuleReconcilerBurst is the burst size allowed on top of
+	// RoutingRuleReconcilerRateLimit.
+	RoutingRuleReconcilerBurst = 5
+
+	// RoutingCIDRFwMark is the default fwmark applied, via an iptables
+	// mangle rule, to traffic whose destination is a member of an
+	// endpoint's CIDR ipset. A single ip rule matching this fwmark then
+	// steers that traffic into the endpoint's routing table, in lieu of
+	// one ip rule per CIDR.
+	RoutingCIDRFwMark = 0x200
+
+	// RoutingCIDRFwMarkMask is the mask applied when matching
+	// RoutingCIDRFwMark, leaving the rest of the fwmark bit space free for
+	// other users of policy routing on the same host (e.g. egress
+	// gateway, WireGuard).
+	RoutingCIDRFwMarkMask = 0xf00
+
+	// RoutingCIDRFwMarkProbePriority is the ip rule priority used to probe,
+	// once, whether the kernel accepts a masked fwmark rule match. It is
+	// deliberately outside the RulePriorityIngress/Egress(V6) bands so the
+	// probe rule, which is deleted immediately after being added, can never
+	// collide with a real endpoint's rules.
+	RoutingCIDRFwMarkProbePriority = 32766
+)
+
+// RoutingRuleReconcilerPollInterval is how often the linuxrouting reconciler
+// polls for rules that need to be restored. vishvananda/netlink has no
+// rule-change notification API to react to instead, unlike routes, which the
+// reconciler still learns about immediately via RouteSubscribeWithOptions;
+// polling is this gap's fallback, and also serves as a backstop in case a
+// route notification is ever missed.
+const RoutingRuleReconcilerPollInterval = 2 * time.Second
+
+// RoutingIPSetModeFlag is the reserved agent flag name for enabling
+// RoutingInfo's IPSetMode, i.e. matching an endpoint's additional CIDRs via
+// a single ipset and fwmark rule instead of one route per CIDR. Nothing in
+// this tree registers it against an agent flag set yet; it exists so that
+// whichever command package owns flag registration can refer to one
+// well-known name instead of each caller inventing its own.
+const RoutingIPSetModeFlag = "linux-routing-ipset"
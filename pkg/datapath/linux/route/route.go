@@ -0,0 +1,267 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+// Package route provides convenience wrappers around the subset of
+// netlink's route and rule handling that the Linux datapath needs.
+package route
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkHandle is the subset of vishvananda/netlink that this package
+// needs in order to program rules and routes. It exists so that callers
+// (notably pkg/datapath/linux/routing) can inject a fake implementation in
+// unit tests that cannot rely on root privileges or a network namespace.
+// Any type satisfying pkg/datapath/linux/routing's larger NetlinkHandle
+// interface also satisfies this one.
+type NetlinkHandle interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error)
+	LinkByName(name string) (netlink.Link, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+}
+
+type realNetlinkHandle struct{}
+
+func (realNetlinkHandle) RuleAdd(rule *netlink.Rule) error { return netlink.RuleAdd(rule) }
+func (realNetlinkHandle) RuleDel(rule *netlink.Rule) error { return netlink.RuleDel(rule) }
+func (realNetlinkHandle) RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error) {
+	return netlink.RuleListFiltered(family, filter, filterMask)
+}
+func (realNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+func (realNetlinkHandle) RouteReplace(r *netlink.Route) error { return netlink.RouteReplace(r) }
+func (realNetlinkHandle) RouteDel(r *netlink.Route) error     { return netlink.RouteDel(r) }
+
+// DefaultHandle is the NetlinkHandle used by Upsert, Delete, ReplaceRule,
+// DeleteRule and ListRules. Tests that need isolation from the host should
+// call the *WithHandle variants instead of swapping this global.
+var DefaultHandle NetlinkHandle = realNetlinkHandle{}
+
+// Route is a linux route, typically with a scope of universe (global), with
+// various function to convert between the kernel representation and the
+// representation we prefer to work with.
+type Route struct {
+	Table   int
+	Nexthop *net.IP
+	Local   net.IP
+	Device  string
+	Prefix  net.IPNet
+	MTU     int
+	Proto   int
+	Type    int
+	Scope   netlink.Scope
+}
+
+// Rule is a rule related to a network resource/interface. It is derived from
+// netlink.Rule, but has some redundant fields removed and simplified.
+type Rule struct {
+	// Priority is the rule priority
+	Priority int
+
+	// From is the source address selector of the rule.
+	From *net.IPNet
+
+	// To is the destination address selector of the rule.
+	To *net.IPNet
+
+	// Mark is the fwmark value to match.
+	Mark uint32
+
+	// Mask is the fwmark mask applied before matching Mark.
+	Mask uint32
+
+	// Table is the routing table referenced by the rule.
+	Table int
+}
+
+func toIfindex(handle NetlinkHandle, ifaceName string) (int, error) {
+	link, err := handle.LinkByName(ifaceName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to lookup interface %s: %w", ifaceName, err)
+	}
+	return link.Attrs().Index, nil
+}
+
+func getNetlinkRoute(route Route, ifindex int) netlink.Route {
+	rt := netlink.Route{
+		LinkIndex: ifindex,
+		Dst:       &route.Prefix,
+		MTU:       route.MTU,
+		Table:     route.Table,
+		Type:      route.Type,
+		Scope:     route.Scope,
+	}
+
+	if route.Nexthop != nil {
+		rt.Gw = *route.Nexthop
+	}
+
+	if route.Local != nil {
+		rt.Src = route.Local
+	}
+
+	return rt
+}
+
+// Upsert inserts or updates a route on the host. It will create the route
+// via ifindex resolution of the route.Device field.
+func Upsert(route Route) error {
+	return UpsertWithHandle(DefaultHandle, route)
+}
+
+// UpsertWithHandle is Upsert with an injectable NetlinkHandle.
+func UpsertWithHandle(handle NetlinkHandle, route Route) error {
+	ifindex, err := toIfindex(handle, route.Device)
+	if err != nil {
+		return err
+	}
+
+	rt := getNetlinkRoute(route, ifindex)
+	return handle.RouteReplace(&rt)
+}
+
+// Delete deletes a route from the host.
+func Delete(route Route) error {
+	return DeleteWithHandle(DefaultHandle, route)
+}
+
+// DeleteWithHandle is Delete with an injectable NetlinkHandle.
+func DeleteWithHandle(handle NetlinkHandle, route Route) error {
+	ifindex, err := toIfindex(handle, route.Device)
+	if err != nil {
+		return err
+	}
+
+	rt := getNetlinkRoute(route, ifindex)
+	return handle.RouteDel(&rt)
+}
+
+func toNetlinkRule(r *Rule, family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = r.Priority
+	rule.Table = r.Table
+	rule.Mark = r.Mark
+	if r.Mask != 0 {
+		mask := r.Mask
+		rule.Mask = &mask
+	}
+	rule.Family = family
+	rule.Src = r.From
+	rule.Dst = r.To
+
+	return rule
+}
+
+// ReplaceRule adds or replaces an ip rule for the given family.
+func ReplaceRule(r Rule, family int) error {
+	return ReplaceRuleWithHandle(DefaultHandle, r, family)
+}
+
+// ReplaceRuleWithHandle is ReplaceRule with an injectable NetlinkHandle. It
+// is idempotent: netlink.RuleAdd uses NLM_F_EXCL and returns EEXIST if an
+// identical rule is already installed, which would otherwise make a second
+// Configure of an already-configured endpoint fail, so an equivalent rule
+// already at r.Priority is treated as success rather than re-added.
+func ReplaceRuleWithHandle(handle NetlinkHandle, r Rule, family int) error {
+	existing, err := ListRulesWithHandle(handle, family, &Rule{Priority: r.Priority})
+	if err != nil {
+		return fmt.Errorf("unable to list existing rules at priority %d: %w", r.Priority, err)
+	}
+
+	rule := toNetlinkRule(&r, family)
+	for i := range existing {
+		if ruleEqual(&existing[i], rule) {
+			return nil
+		}
+	}
+
+	return handle.RuleAdd(rule)
+}
+
+// ruleEqual reports whether a and b select the same traffic into the same
+// table. It ignores Priority and Family, which the caller's listing already
+// filtered on, and fields (like OifIndex) that toNetlinkRule never sets and
+// so are always zero on b.
+func ruleEqual(a, b *netlink.Rule) bool {
+	return a.Table == b.Table &&
+		a.Mark == b.Mark &&
+		maskEqual(a.Mask, b.Mask) &&
+		ipNetEqual(a.Src, b.Src) &&
+		ipNetEqual(a.Dst, b.Dst)
+}
+
+// maskEqual compares two *uint32 fwmark masks by value, treating a nil mask
+// (no FRA_FWMASK attribute) the same as a mask of 0.
+func maskEqual(a, b *uint32) bool {
+	var av, bv uint32
+	if a != nil {
+		av = *a
+	}
+	if b != nil {
+		bv = *b
+	}
+	return av == bv
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// DeleteRule deletes an ip rule matching the given filter for the given
+// family.
+func DeleteRule(r Rule, family int) error {
+	return DeleteRuleWithHandle(DefaultHandle, r, family)
+}
+
+// DeleteRuleWithHandle is DeleteRule with an injectable NetlinkHandle.
+func DeleteRuleWithHandle(handle NetlinkHandle, r Rule, family int) error {
+	rule := toNetlinkRule(&r, family)
+	return handle.RuleDel(rule)
+}
+
+// ListRules returns all rules on the host that match the provided filter,
+// or all rules if filter is nil.
+func ListRules(family int, filter *Rule) ([]netlink.Rule, error) {
+	return ListRulesWithHandle(DefaultHandle, family, filter)
+}
+
+// ListRulesWithHandle is ListRules with an injectable NetlinkHandle.
+func ListRulesWithHandle(handle NetlinkHandle, family int, filter *Rule) ([]netlink.Rule, error) {
+	var netlinkFilter *netlink.Rule
+	var filterMask uint64
+
+	if filter != nil {
+		netlinkFilter = toNetlinkRule(filter, family)
+		if filter.Priority != 0 {
+			filterMask |= netlink.RT_FILTER_PRIORITY
+		}
+		if filter.Table != 0 {
+			filterMask |= netlink.RT_FILTER_TABLE
+		}
+		if filter.From != nil {
+			filterMask |= netlink.RT_FILTER_SRC
+		}
+		if filter.To != nil {
+			filterMask |= netlink.RT_FILTER_DST
+		}
+		if filter.Mark != 0 {
+			filterMask |= netlink.RT_FILTER_MARK
+		}
+		if filter.Mask != 0 {
+			filterMask |= netlink.RT_FILTER_MASK
+		}
+	}
+
+	return handle.RuleListFiltered(family, netlinkFilter, filterMask)
+}
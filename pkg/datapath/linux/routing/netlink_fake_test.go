@@ -0,0 +1,496 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+//go:build linux
+
+package linuxrouting
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	ipamOption "github.com/cilium/cilium/pkg/ipam/option"
+	"github.com/cilium/cilium/pkg/mac"
+)
+
+// fakeNetlinkHandle is an in-memory NetlinkHandle that models enough of the
+// kernel's rule/route/link tables to exercise RoutingInfo.Configure and
+// Delete without root privileges or a network namespace. It is deliberately
+// conservative about what counts as a "duplicate": any two rules that are
+// identical across every field participating in kernel rule matching
+// (family, priority, table, src, dst, mark, mask) are rejected the same way
+// RTNETLINK rejects `ip rule add` of an existing rule.
+type fakeNetlinkHandle struct {
+	mu     sync.Mutex
+	links  []netlink.Link
+	rules  []netlink.Rule
+	routes []netlink.Route
+}
+
+func newFakeNetlinkHandle(links ...netlink.Link) *fakeNetlinkHandle {
+	return &fakeNetlinkHandle{links: links}
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// maskPtrEqual compares two *uint32 fwmark masks by value, treating a nil
+// mask the same as a mask of 0, the way the kernel treats a rule with no
+// FRA_FWMASK attribute.
+func maskPtrEqual(a, b *uint32) bool {
+	var av, bv uint32
+	if a != nil {
+		av = *a
+	}
+	if b != nil {
+		bv = *b
+	}
+	return av == bv
+}
+
+func (f *fakeNetlinkHandle) RuleAdd(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range f.rules {
+		if r.Family == rule.Family && r.Priority == rule.Priority && r.Table == rule.Table &&
+			r.Mark == rule.Mark && maskPtrEqual(r.Mask, rule.Mask) &&
+			ipNetEqual(r.Src, rule.Src) && ipNetEqual(r.Dst, rule.Dst) {
+			return fmt.Errorf("file exists")
+		}
+	}
+
+	f.rules = append(f.rules, *rule)
+	return nil
+}
+
+func (f *fakeNetlinkHandle) RuleDel(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, r := range f.rules {
+		if r.Family == rule.Family && r.Priority == rule.Priority && r.Table == rule.Table {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such rule")
+}
+
+func (f *fakeNetlinkHandle) RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []netlink.Rule
+	for _, r := range f.rules {
+		if family != netlink.FAMILY_ALL && r.Family != family {
+			continue
+		}
+		if filter != nil {
+			if filterMask&netlink.RT_FILTER_PRIORITY != 0 && r.Priority != filter.Priority {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_SRC != 0 && !ipNetEqual(r.Src, filter.Src) {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_DST != 0 && !ipNetEqual(r.Dst, filter.Dst) {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_MARK != 0 && r.Mark != filter.Mark {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_MASK != 0 && !maskPtrEqual(r.Mask, filter.Mask) {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (f *fakeNetlinkHandle) RouteReplace(rt *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, existing := range f.routes {
+		if existing.Table == rt.Table && existing.LinkIndex == rt.LinkIndex && ipNetEqual(existing.Dst, rt.Dst) {
+			f.routes[i] = *rt
+			return nil
+		}
+	}
+	f.routes = append(f.routes, *rt)
+	return nil
+}
+
+func (f *fakeNetlinkHandle) RouteDel(rt *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, existing := range f.routes {
+		if existing.Table == rt.Table && ipNetEqual(existing.Dst, rt.Dst) {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such route")
+}
+
+func (f *fakeNetlinkHandle) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []netlink.Route
+	for _, rt := range f.routes {
+		if filter != nil && filterMask&netlink.RT_FILTER_TABLE != 0 && rt.Table != filter.Table {
+			continue
+		}
+		out = append(out, rt)
+	}
+	return out, nil
+}
+
+func (f *fakeNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+func (f *fakeNetlinkHandle) LinkList() ([]netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]netlink.Link, len(f.links))
+	copy(out, f.links)
+	return out, nil
+}
+
+var _ NetlinkHandle = (*fakeNetlinkHandle)(nil)
+
+func fakeTestRoutingInfo(t *testing.T) RoutingInfo {
+	t.Helper()
+
+	ri, err := parse(
+		"192.168.2.1",
+		"",
+		[]string{"192.168.0.0/16"},
+		"00:11:22:33:44:55",
+		"1",
+		ipamOption.IPAMENI,
+		true,
+		false,
+	)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return *ri
+}
+
+func fakeTestLink(ri RoutingInfo) netlink.Link {
+	return &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         "linuxrout-fake",
+			HardwareAddr: net.HardwareAddr(ri.MasterIfMAC),
+			Index:        42,
+		},
+	}
+}
+
+func TestFakeConfigureAndDelete(t *testing.T) {
+	ri := fakeTestRoutingInfo(t)
+	handle := newFakeNetlinkHandle(fakeTestLink(ri))
+
+	ip := netip.MustParseAddr("192.168.2.123")
+
+	if err := ri.ConfigureWithHandle(handle, nil, ip.AsSlice(), 1500, false); err != nil {
+		t.Fatalf("ConfigureWithHandle: %v", err)
+	}
+	if len(handle.rules) == 0 {
+		t.Fatal("expected rules to be installed")
+	}
+	if len(handle.routes) == 0 {
+		t.Fatal("expected routes to be installed")
+	}
+
+	if err := DeleteWithHandle(handle, nil, ip, false); err != nil {
+		t.Fatalf("DeleteWithHandle: %v", err)
+	}
+	if len(handle.rules) != 0 {
+		t.Fatalf("expected all rules to be removed, got %d", len(handle.rules))
+	}
+	if len(handle.routes) != 0 {
+		t.Fatalf("expected all routes to be removed, got %d", len(handle.routes))
+	}
+}
+
+func TestFakeConfigureRouteWithIncompatibleIP(t *testing.T) {
+	ri := fakeTestRoutingInfo(t)
+	handle := newFakeNetlinkHandle(fakeTestLink(ri))
+
+	ipv6 := netip.MustParseAddr("fd00::2")
+	err := ri.ConfigureWithHandle(handle, nil, ipv6.AsSlice(), 1500, false)
+	if err == nil || err.Error() != "IP not compatible" {
+		t.Fatalf("expected IP not compatible error, got %v", err)
+	}
+}
+
+func TestFakeDeleteRouteWithIncompatibleIP(t *testing.T) {
+	handle := newFakeNetlinkHandle()
+
+	// Delete accepts both IPv4 and IPv6 addresses; only an address of
+	// neither family (the zero netip.Addr) is incompatible.
+	var invalid netip.Addr
+	err := DeleteWithHandle(handle, nil, invalid, false)
+	if err == nil || err.Error() != "IP not compatible" {
+		t.Fatalf("expected IP not compatible error, got %v", err)
+	}
+}
+
+func TestFakeDeleteIPDoesNotMatchRules(t *testing.T) {
+	ri := fakeTestRoutingInfo(t)
+	handle := newFakeNetlinkHandle(fakeTestLink(ri))
+
+	configuredIP := netip.MustParseAddr("192.168.2.123")
+	if err := ri.ConfigureWithHandle(handle, nil, configuredIP.AsSlice(), 1500, false); err != nil {
+		t.Fatalf("ConfigureWithHandle: %v", err)
+	}
+
+	other := netip.MustParseAddr("192.168.2.233")
+	if err := DeleteWithHandle(handle, nil, other, false); err == nil {
+		t.Fatal("expected an error deleting an IP with no matching ingress rule")
+	}
+}
+
+// TestFakeDeleteIPMatchesMoreThanExpected ports the privileged
+// "IP addr matches more than number expected" scenario: a near-duplicate
+// ingress rule (same Dst, but with Src additionally set, since ingress rules
+// normally only match on Dst) makes Delete's own ambiguity check fail before
+// it touches the kernel.
+func TestFakeDeleteIPMatchesMoreThanExpected(t *testing.T) {
+	ri := fakeTestRoutingInfo(t)
+	handle := newFakeNetlinkHandle(fakeTestLink(ri))
+
+	ip := netip.MustParseAddr("192.168.2.233")
+	if err := ri.ConfigureWithHandle(handle, nil, ip.AsSlice(), 1500, false); err != nil {
+		t.Fatalf("ConfigureWithHandle: %v", err)
+	}
+
+	rules, err := handle.RuleListFiltered(netlink.FAMILY_V4, nil, 0)
+	if err != nil {
+		t.Fatalf("RuleListFiltered: %v", err)
+	}
+
+	var ingress netlink.Rule
+	for _, r := range rules {
+		if r.Dst != nil && r.Dst.IP.Equal(net.IP(ip.AsSlice())) {
+			ingress = r
+			break
+		}
+	}
+	if ingress.Dst == nil {
+		t.Fatal("expected to find the configured ingress rule")
+	}
+
+	near := ingress
+	near.Src = &net.IPNet{IP: ip.AsSlice(), Mask: net.CIDRMask(32, 32)}
+	if err := handle.RuleAdd(&near); err != nil {
+		t.Fatalf("RuleAdd near-duplicate: %v", err)
+	}
+
+	if err := DeleteWithHandle(handle, nil, ip, false); err == nil {
+		t.Fatal("expected an error due to ambiguous ingress rule match")
+	}
+}
+
+func TestFakeNetlinkHandleRejectsDuplicateRule(t *testing.T) {
+	handle := newFakeNetlinkHandle()
+
+	r := &netlink.Rule{Family: netlink.FAMILY_V4, Priority: 100, Table: 100}
+	if err := handle.RuleAdd(r); err != nil {
+		t.Fatalf("first RuleAdd: %v", err)
+	}
+	if err := handle.RuleAdd(r); err == nil {
+		t.Fatal("expected duplicate RuleAdd to fail")
+	}
+}
+
+// fakeCIDRSetManager is an in-memory cidrSetManager that records calls
+// instead of shelling out to ipset/iptables, so that IPSetMode endpoints can
+// be exercised by these unprivileged, no-root tests the same way plain
+// endpoints already are by fakeNetlinkHandle.
+type fakeCIDRSetManager struct {
+	mu      sync.Mutex
+	members map[string][]netip.Prefix
+	marked  map[string]bool
+}
+
+func newFakeCIDRSetManager() *fakeCIDRSetManager {
+	return &fakeCIDRSetManager{
+		members: map[string][]netip.Prefix{},
+		marked:  map[string]bool{},
+	}
+}
+
+func (f *fakeCIDRSetManager) ensure(name string, family int, cidrs []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members[name] = append([]netip.Prefix(nil), cidrs...)
+	return nil
+}
+
+func (f *fakeCIDRSetManager) destroy(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.members, name)
+	return nil
+}
+
+func (f *fakeCIDRSetManager) markCIDRTraffic(name string, family int, mark, mask int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.marked[name] = true
+	return nil
+}
+
+func (f *fakeCIDRSetManager) unmarkCIDRTraffic(name string, family int, mark, mask int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.marked, name)
+	return nil
+}
+
+var _ cidrSetManager = (*fakeCIDRSetManager)(nil)
+
+// TestFakeConfigureIPSetModeUsesInjectedSetManager exercises IPSetMode end
+// to end against fakes of both NetlinkHandle and cidrSetManager, proving
+// that an IPSetMode endpoint can be configured and deleted without shelling
+// out to ipset/iptables on the host.
+func TestFakeConfigureIPSetModeUsesInjectedSetManager(t *testing.T) {
+	ri, err := parse(
+		"192.168.2.1",
+		"",
+		[]string{"192.168.0.0/16"},
+		"00:11:22:33:44:66",
+		"2",
+		ipamOption.IPAMENI,
+		true,
+		true,
+	)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	handle := newFakeNetlinkHandle(fakeTestLink(*ri))
+	setMgr := newFakeCIDRSetManager()
+
+	ip := netip.MustParseAddr("192.168.2.123")
+	if err := ri.ConfigureWithHandle(handle, setMgr, ip.AsSlice(), 1500, false); err != nil {
+		t.Fatalf("ConfigureWithHandle: %v", err)
+	}
+
+	if len(setMgr.members) != 1 {
+		t.Fatalf("expected exactly one ipset to be programmed, got %d", len(setMgr.members))
+	}
+	var setName string
+	for name, cidrs := range setMgr.members {
+		setName = name
+		if len(cidrs) != 1 || cidrs[0].String() != "192.168.0.0/16" {
+			t.Fatalf("expected ipset to hold 192.168.0.0/16, got %v", cidrs)
+		}
+	}
+	if !setMgr.marked[setName] {
+		t.Fatal("expected the ipset's traffic to be marked")
+	}
+
+	if err := DeleteWithHandle(handle, setMgr, ip, false); err != nil {
+		t.Fatalf("DeleteWithHandle: %v", err)
+	}
+	if len(setMgr.members) != 0 {
+		t.Fatalf("expected the ipset to be destroyed, got %v", setMgr.members)
+	}
+	if len(setMgr.marked) != 0 {
+		t.Fatalf("expected the mark rule to be removed, got %v", setMgr.marked)
+	}
+}
+
+// TestFakeDeleteIPSetModeSurvivesEgressRuleReinsertion proves that deleting
+// an IPSetMode endpoint removes the right rule even when the plain egress
+// rule happens to sit after the CIDR fwmark rule in the kernel's rule list,
+// e.g. because the reconciler restored a deleted egress rule after the
+// fwmark rule was already installed. Before the egress and fwmark rules were
+// split into distinct priority bands, DeleteWithHandle's egress-rule delete
+// only filtered on Priority and Table, so it matched whichever of the two
+// rules the handle happened to return first.
+func TestFakeDeleteIPSetModeSurvivesEgressRuleReinsertion(t *testing.T) {
+	ri, err := parse(
+		"192.168.2.1",
+		"",
+		[]string{"192.168.0.0/16"},
+		"00:11:22:33:44:66",
+		"2",
+		ipamOption.IPAMENI,
+		true,
+		true,
+	)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	handle := newFakeNetlinkHandle(fakeTestLink(*ri))
+	setMgr := newFakeCIDRSetManager()
+
+	ip := netip.MustParseAddr("192.168.2.123")
+	if err := ri.ConfigureWithHandle(handle, setMgr, ip.AsSlice(), 1500, false); err != nil {
+		t.Fatalf("ConfigureWithHandle: %v", err)
+	}
+
+	p, err := ri.familyParamsFor(ip)
+	if err != nil {
+		t.Fatalf("familyParamsFor: %v", err)
+	}
+
+	// Simulate an external actor deleting the egress rule, and the
+	// reconciler restoring it afterwards: remove it, then re-add it so it
+	// now sits after the fwmark rule in handle.rules.
+	if err := handle.RuleDel(&netlink.Rule{Family: p.family, Priority: p.egressPriority, Table: p.table}); err != nil {
+		t.Fatalf("RuleDel egress: %v", err)
+	}
+	if err := handle.RuleAdd(&netlink.Rule{Family: p.family, Priority: p.egressPriority, Table: p.table, Src: hostIPNet(ip)}); err != nil {
+		t.Fatalf("RuleAdd egress: %v", err)
+	}
+
+	if err := DeleteWithHandle(handle, setMgr, ip, false); err != nil {
+		t.Fatalf("DeleteWithHandle: %v", err)
+	}
+
+	rules, err := handle.RuleListFiltered(p.family, &netlink.Rule{Table: p.table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatalf("RuleListFiltered: %v", err)
+	}
+	if len(rules) != 0 {
+		t.Fatalf("expected all rules for table %d to be gone, got %v", p.table, rules)
+	}
+	if len(setMgr.members) != 0 {
+		t.Fatalf("expected the ipset to be destroyed, got %v", setMgr.members)
+	}
+	if len(setMgr.marked) != 0 {
+		t.Fatalf("expected the mark rule to be removed, got %v", setMgr.marked)
+	}
+}
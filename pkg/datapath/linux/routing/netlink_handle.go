@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+//go:build linux
+
+package linuxrouting
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkHandle is the subset of vishvananda/netlink that RoutingInfo needs
+// in order to program and inspect rules, routes and links. Configure and
+// Delete take one of these as an explicit dependency (via the *WithHandle
+// variants) so that unit tests can exercise the reconciliation logic with an
+// in-memory fake instead of a real, root-owned network namespace. Any type
+// satisfying this interface also satisfies pkg/datapath/linux/route's
+// smaller NetlinkHandle interface.
+type NetlinkHandle interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error)
+
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+}
+
+// realNetlinkHandle implements NetlinkHandle by calling directly into
+// vishvananda/netlink's package-level functions against the host's current
+// network namespace.
+type realNetlinkHandle struct{}
+
+// DefaultNetlinkHandle is the NetlinkHandle used by Configure and Delete.
+// Tests that want isolation from the host should call ConfigureWithHandle /
+// DeleteWithHandle with a fake NetlinkHandle instead of swapping this
+// global.
+var DefaultNetlinkHandle NetlinkHandle = realNetlinkHandle{}
+
+func (realNetlinkHandle) RuleAdd(rule *netlink.Rule) error { return netlink.RuleAdd(rule) }
+func (realNetlinkHandle) RuleDel(rule *netlink.Rule) error { return netlink.RuleDel(rule) }
+func (realNetlinkHandle) RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error) {
+	return netlink.RuleListFiltered(family, filter, filterMask)
+}
+
+func (realNetlinkHandle) RouteReplace(r *netlink.Route) error { return netlink.RouteReplace(r) }
+func (realNetlinkHandle) RouteDel(r *netlink.Route) error     { return netlink.RouteDel(r) }
+func (realNetlinkHandle) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, filterMask)
+}
+
+func (realNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+func (realNetlinkHandle) LinkList() ([]netlink.Link, error) { return netlink.LinkList() }
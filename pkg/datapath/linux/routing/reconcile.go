@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+//go:build linux
+
+package linuxrouting
+
+import (
+	"net/netip"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/time/rate"
+
+	"github.com/cilium/cilium/pkg/datapath/linux/linux_defaults"
+	"github.com/cilium/cilium/pkg/datapath/linux/route"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "linuxrouting")
+
+var (
+	restoredRulesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cilium",
+		Subsystem: "linuxrouting",
+		Name:      "restored_rules_total",
+		Help:      "Number of ip rules that were re-installed after being deleted or modified out-of-band",
+	})
+	restoredRoutesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cilium",
+		Subsystem: "linuxrouting",
+		Name:      "restored_routes_total",
+		Help:      "Number of routes that were re-installed after being deleted or modified out-of-band",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(restoredRulesTotal, restoredRoutesTotal)
+}
+
+// endpointRules is the set of rules and routes that Configure installed for
+// a single endpoint IP, kept around so that ruleReconciler can tell whether
+// they are still present on the host and re-install them if not.
+type endpointRules struct {
+	family int
+	rules  []route.Rule
+	routes []route.Route
+	handle NetlinkHandle
+}
+
+// ruleReconciler watches for rule and route deletions/changes on the host
+// and restores any of them that belong to an endpoint we are still tracking.
+// It is modeled after Tailscale's ruleRestorePending watcher, adapted to
+// vishvananda/netlink's actual API: routes get a real change-notification
+// channel (RouteSubscribeWithOptions), but the library has no equivalent for
+// rules, so rule restoration instead falls back to polling every
+// linux_defaults.RoutingRuleReconcilerPollInterval. A rate limiter on top of
+// both triggers bounds how often a hostile or mistaken external actor can
+// force us into a restore loop.
+//
+// The watch goroutine is started the first time an endpoint is tracked and
+// stopped once the last one is untracked, rather than once per process
+// lifetime: it pins itself to whatever network namespace is current at
+// start time (see watch), and restarting it on every 0-to-1 transition is
+// what lets each privileged test's own temporary netns get its own watcher
+// instead of every test after the first silently watching the first test's
+// (by-then-long-gone) namespace.
+type ruleReconciler struct {
+	mu      sync.Mutex
+	tracked map[netip.Addr]endpointRules
+	limiter *rate.Limiter
+
+	stop chan struct{} // non-nil while a watch goroutine is running
+}
+
+var defaultReconciler = &ruleReconciler{
+	tracked: make(map[netip.Addr]endpointRules),
+	limiter: rate.NewLimiter(
+		rate.Limit(linux_defaults.RoutingRuleReconcilerRateLimit),
+		linux_defaults.RoutingRuleReconcilerBurst,
+	),
+}
+
+// track records the rules and routes that were just installed for ip so
+// that they can be restored if an external actor deletes or modifies them.
+// It also starts the watch goroutine if this is the first tracked endpoint.
+func (r *ruleReconciler) track(ip netip.Addr, family int, rules []route.Rule, routes []route.Route, handle NetlinkHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tracked[ip] = endpointRules{family: family, rules: rules, routes: routes, handle: handle}
+
+	// The background watch only makes sense against the real host netlink
+	// socket; endpoints tracked with a fake handle (as in unit tests) are
+	// never reconciled in the background, so skip starting it in that case.
+	if handle != NetlinkHandle(DefaultNetlinkHandle) || r.stop != nil {
+		return
+	}
+
+	ns, err := netns.Get()
+	if err != nil {
+		log.WithError(err).Error("Unable to determine current network namespace, automatic rule/route repair is disabled")
+		return
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	go r.watch(ns, stop)
+}
+
+// untrack stops restoring rules and routes for ip, e.g. because Delete is
+// about to remove them on purpose. It also stops the watch goroutine once
+// the last tracked endpoint is gone.
+func (r *ruleReconciler) untrack(ip netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tracked, ip)
+
+	if len(r.tracked) == 0 && r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// watch reconciles our tracked state whenever a route change is reported or,
+// failing any notification for rules, on every poll interval. It pins
+// itself to ns for its entire lifetime, so that it keeps observing the
+// namespace that was current when it was started rather than whatever
+// namespace its goroutine happens to be scheduled on.
+func (r *ruleReconciler) watch(ns netns.NsHandle, stop chan struct{}) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		log.WithError(err).Error("Unable to enter tracked network namespace, automatic rule/route repair is disabled")
+		return
+	}
+
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribeWithOptions(routeUpdates, stop, netlink.RouteSubscribeOptions{}); err != nil {
+		log.WithError(err).Error("Unable to subscribe to route updates, falling back to polling alone")
+		routeUpdates = nil
+	}
+
+	ticker := time.NewTicker(linux_defaults.RoutingRuleReconcilerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-routeUpdates:
+			if !ok {
+				routeUpdates = nil
+				continue
+			}
+			r.reconcile()
+		case <-ticker.C:
+			r.reconcile()
+		}
+	}
+}
+
+// reconcile re-installs any tracked rule or route that is no longer present
+// on the host. A single rate limiter guards both rules and routes, since a
+// misbehaving external actor deleting either is equally capable of driving a
+// tight loop.
+func (r *ruleReconciler) reconcile() {
+	if !r.limiter.Allow() {
+		return
+	}
+
+	r.mu.Lock()
+	tracked := make(map[netip.Addr]endpointRules, len(r.tracked))
+	for ip, er := range r.tracked {
+		tracked[ip] = er
+	}
+	r.mu.Unlock()
+
+	for ip, er := range tracked {
+		for _, rule := range er.rules {
+			present, err := ruleExists(er.handle, er.family, rule)
+			if err != nil {
+				log.WithError(err).WithField(logfields.IPAddr, ip).Warning("Unable to verify ip rule while reconciling")
+				continue
+			}
+			if present {
+				continue
+			}
+			if err := route.ReplaceRuleWithHandle(er.handle, rule, er.family); err != nil {
+				log.WithError(err).WithField(logfields.IPAddr, ip).Error("Unable to restore deleted ip rule")
+				continue
+			}
+			restoredRulesTotal.Inc()
+		}
+
+		for _, rt := range er.routes {
+			present, err := routeExists(er.handle, er.family, rt)
+			if err != nil {
+				log.WithError(err).WithField(logfields.IPAddr, ip).Warning("Unable to verify route while reconciling")
+				continue
+			}
+			if present {
+				continue
+			}
+			if err := route.UpsertWithHandle(er.handle, rt); err != nil {
+				log.WithError(err).WithField(logfields.IPAddr, ip).Error("Unable to restore deleted route")
+				continue
+			}
+			restoredRoutesTotal.Inc()
+		}
+	}
+}
+
+func ruleExists(handle NetlinkHandle, family int, rule route.Rule) (bool, error) {
+	rules, err := route.ListRulesWithHandle(handle, family, &rule)
+	if err != nil {
+		return false, err
+	}
+	return len(rules) > 0, nil
+}
+
+func routeExists(handle NetlinkHandle, family int, rt route.Route) (bool, error) {
+	routes, err := handle.RouteListFiltered(family, &netlink.Route{
+		Table: rt.Table,
+		Dst:   &rt.Prefix,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+	if err != nil {
+		return false, err
+	}
+	return len(routes) > 0, nil
+}
@@ -0,0 +1,609 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+//go:build linux
+
+// Package linuxrouting configures the routes and rules needed to route
+// traffic for an endpoint whose IP was handed out by a cloud-provider IPAM
+// (ENI, Azure, AlibabaCloud, ...) via a secondary interface rather than via
+// the main routing table.
+package linuxrouting
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/cilium/cilium/pkg/datapath/linux/linux_defaults"
+	"github.com/cilium/cilium/pkg/datapath/linux/route"
+	"github.com/cilium/cilium/pkg/mac"
+)
+
+// RoutingConfig lets operators move Cilium's policy routing out of the way
+// of another user of the same ip rule priorities or fwmark bits on the same
+// host (Calico, systemd-networkd, WireGuard/Tailscale), following the same
+// approach as Tailscale's ipPolicyPrefBase: rather than hardcoding
+// priorities and a fwmark, both are offsets from a configurable base.
+type RoutingConfig struct {
+	// RulePriorityBase is added to each of linux_defaults'
+	// RulePriorityIngress/Egress(V6) to compute the priority actually used
+	// for ip rules. The zero value reproduces the historical, hardcoded
+	// priorities.
+	RulePriorityBase int
+
+	// CIDRFwMark and CIDRFwMarkMask override linux_defaults.RoutingCIDRFwMark
+	// and RoutingCIDRFwMarkMask for IPSetMode endpoints.
+	CIDRFwMark     int
+	CIDRFwMarkMask int
+}
+
+var currentConfig = RoutingConfig{
+	CIDRFwMark:     linux_defaults.RoutingCIDRFwMark,
+	CIDRFwMarkMask: linux_defaults.RoutingCIDRFwMarkMask,
+}
+
+// SetRoutingConfig overrides the priority base and fwmark/mask used by
+// Configure and Delete. It is meant to be called once, at agent startup,
+// before any endpoint is configured; changing it afterwards does not
+// retroactively move rules and routes already installed under the previous
+// configuration.
+func SetRoutingConfig(cfg RoutingConfig) {
+	currentConfig = cfg
+}
+
+var (
+	fwMarkMaskProbeMu     sync.Mutex
+	fwMarkMaskProbeResult = map[fwMarkMaskProbeKey]bool{}
+)
+
+// fwMarkMaskProbeKey identifies one memoized probe outcome. The outcome
+// depends on both the handle (a fake in tests accepts whatever it's told,
+// a given real handle reflects one kernel) and the family (a kernel can, in
+// principle, support masked fwmark rules for one family but not the other).
+type fwMarkMaskProbeKey struct {
+	handle NetlinkHandle
+	family int
+}
+
+// probeFwMarkMaskSupport checks, once per handle and family, whether the
+// running kernel accepts ip rules that match on a fwmark with an
+// accompanying mask. Kernels that predate this support reject the probe
+// rule outright, in which case IPSetMode falls back to matching the fwmark
+// exactly, with an all-ones mask: still correct, just less able to share the
+// mark's unused bits with another policy-routing user.
+func probeFwMarkMaskSupport(handle NetlinkHandle, family int) bool {
+	key := fwMarkMaskProbeKey{handle: handle, family: family}
+
+	fwMarkMaskProbeMu.Lock()
+	defer fwMarkMaskProbeMu.Unlock()
+
+	if supported, ok := fwMarkMaskProbeResult[key]; ok {
+		return supported
+	}
+
+	probe := route.Rule{
+		Priority: linux_defaults.RoutingCIDRFwMarkProbePriority,
+		Mark:     1,
+		Mask:     1,
+		Table:    unix.RT_TABLE_UNSPEC,
+	}
+	supported := true
+	if err := route.ReplaceRuleWithHandle(handle, probe, family); err != nil {
+		supported = false
+	} else {
+		_ = route.DeleteRuleWithHandle(handle, probe, family)
+	}
+
+	fwMarkMaskProbeResult[key] = supported
+	return supported
+}
+
+// RoutingInfo represents the information necessary to set up rules and
+// routes for the datapath to send egress traffic out of an interface that is
+// not the default interface of the machine, and receive ingress traffic
+// destined to an endpoint IP assigned to that interface.
+//
+// An endpoint may be dual-stack, in which case both the IPv4 and IPv6
+// fields below are populated; a single-stack endpoint only populates the
+// fields for its own family, leaving the other family's Gateway as the
+// zero netip.Addr.
+type RoutingInfo struct {
+	// IPv4Gateway is the gateway IP address of the IPv4 subnet that the
+	// endpoint's primary interface is assigned to.
+	IPv4Gateway netip.Addr
+
+	// IPv4CIDRs is the set of additional IPv4 CIDRs that must be routed via
+	// the endpoint's primary interface.
+	IPv4CIDRs []netip.Prefix
+
+	// IPv6Gateway is the gateway IP address of the IPv6 subnet that the
+	// endpoint's primary interface is assigned to. It is the zero value for
+	// endpoints that are not dual-stack capable.
+	IPv6Gateway netip.Addr
+
+	// IPv6CIDRs is the IPv6 equivalent of IPv4CIDRs.
+	IPv6CIDRs []netip.Prefix
+
+	// MasterIfMAC is the MAC address of the master interface that the
+	// endpoint's traffic egresses on (e.g. the ENI).
+	MasterIfMAC mac.MAC
+
+	// Masquerade is true if the agent is configured to masquerade traffic
+	// leaving this interface.
+	Masquerade bool
+
+	// IPSetMode is set from parse's ipsetMode argument; nothing in this tree
+	// wires it to the agent flag reserved for it
+	// (linux_defaults.RoutingIPSetModeFlag). Instead of one route per entry in {IPv4,IPv6}CIDRs, Configure
+	// maintains a single per-endpoint ipset holding all of them, marks
+	// matching traffic with iptables, and steers it into the endpoint's
+	// table with a single fwmark-matching ip rule. This keeps endpoints
+	// with hundreds of CIDRs (e.g. secondary ENI/VPC ranges) fast to
+	// (re)configure.
+	IPSetMode bool
+
+	// ipamMode is the IPAM backend (pkg/ipam/option) that produced this
+	// RoutingInfo. It is recorded by parse and not read anywhere else in
+	// this package.
+	ipamMode string
+
+	// interfaceNumber is used, combined with a per-family table offset, to
+	// compute the routing table dedicated to this interface.
+	interfaceNumber int
+}
+
+// parse returns a new RoutingInfo for the given gateways, CIDRs, master
+// interface MAC and interface number. Either of ipv4Gateway / ipv6Gateway
+// may be empty, in which case the corresponding family is left unconfigured
+// on the returned RoutingInfo. Each entry in cidrs is classified into the
+// IPv4 or IPv6 bucket based on its own address family.
+func parse(ipv4Gateway string, ipv6Gateway string, cidrs []string, macAddr string, ifaceNumber string, ipamMode string, masquerade bool, ipsetMode bool) (*RoutingInfo, error) {
+	var gatewayV4, gatewayV6 netip.Addr
+
+	if ipv4Gateway != "" {
+		gw, err := netip.ParseAddr(ipv4Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPv4 gateway %q: %w", ipv4Gateway, err)
+		}
+		if !gw.Is4() {
+			return nil, fmt.Errorf("gateway %q is not an IPv4 address", ipv4Gateway)
+		}
+		gatewayV4 = gw
+	}
+
+	if ipv6Gateway != "" {
+		gw, err := netip.ParseAddr(ipv6Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPv6 gateway %q: %w", ipv6Gateway, err)
+		}
+		if !gw.Is6() {
+			return nil, fmt.Errorf("gateway %q is not an IPv6 address", ipv6Gateway)
+		}
+		gatewayV6 = gw
+	}
+
+	var cidrsV4, cidrsV6 []netip.Prefix
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		if prefix.Addr().Is4() {
+			cidrsV4 = append(cidrsV4, prefix)
+		} else {
+			cidrsV6 = append(cidrsV6, prefix)
+		}
+	}
+
+	parsedMAC, err := mac.ParseMAC(macAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q: %w", macAddr, err)
+	}
+
+	ifaceNum, err := strconv.Atoi(ifaceNumber)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface number %q: %w", ifaceNumber, err)
+	}
+
+	return &RoutingInfo{
+		IPv4Gateway:     gatewayV4,
+		IPv4CIDRs:       cidrsV4,
+		IPv6Gateway:     gatewayV6,
+		IPv6CIDRs:       cidrsV6,
+		MasterIfMAC:     parsedMAC,
+		Masquerade:      masquerade,
+		IPSetMode:       ipsetMode,
+		ipamMode:        ipamMode,
+		interfaceNumber: ifaceNum,
+	}, nil
+}
+
+// familyParams bundles the family-specific values needed to program rules
+// and routes for one IP family.
+type familyParams struct {
+	family                                               int
+	gateway                                              netip.Addr
+	cidrs                                                []netip.Prefix
+	table                                                int
+	ingressPriority, egressPriority, cidrFwmarkPriority  int
+}
+
+func (info *RoutingInfo) familyParamsFor(addr netip.Addr) (familyParams, error) {
+	switch {
+	case addr.Is4():
+		if !info.IPv4Gateway.IsValid() {
+			return familyParams{}, fmt.Errorf("IP not compatible")
+		}
+		return familyParams{
+			family:             netlink.FAMILY_V4,
+			gateway:            info.IPv4Gateway,
+			cidrs:              info.IPv4CIDRs,
+			table:              linux_defaults.RouteTableInterfacesOffset + info.interfaceNumber,
+			ingressPriority:    currentConfig.RulePriorityBase + linux_defaults.RulePriorityIngress,
+			egressPriority:     currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgress,
+			cidrFwmarkPriority: currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressCIDR,
+		}, nil
+	case addr.Is6():
+		if !info.IPv6Gateway.IsValid() {
+			return familyParams{}, fmt.Errorf("IP not compatible")
+		}
+		return familyParams{
+			family:             netlink.FAMILY_V6,
+			gateway:            info.IPv6Gateway,
+			cidrs:              info.IPv6CIDRs,
+			table:              linux_defaults.RouteTableInterfacesOffsetIPv6 + info.interfaceNumber,
+			ingressPriority:    currentConfig.RulePriorityBase + linux_defaults.RulePriorityIngressV6,
+			egressPriority:     currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressV6,
+			cidrFwmarkPriority: currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressCIDRV6,
+		}, nil
+	default:
+		return familyParams{}, fmt.Errorf("IP not compatible")
+	}
+}
+
+// Configure sets up the rules and routes needed to steer ingress traffic
+// destined to ip, and egress traffic originating from ip, via the endpoint's
+// dedicated routing table. compat additionally installs the default route in
+// the main routing table, for interoperability with agent versions that
+// predate per-interface routing tables. It uses DefaultNetlinkHandle and the
+// real ipset/iptables-backed cidrSetManager; call ConfigureWithHandle
+// directly to inject fakes of either (e.g. in unit tests).
+func (info *RoutingInfo) Configure(ip net.IP, mtu int, compat bool) error {
+	return info.ConfigureWithHandle(DefaultNetlinkHandle, defaultCIDRSetManager, ip, mtu, compat)
+}
+
+// ConfigureWithHandle is Configure with an injectable NetlinkHandle and
+// cidrSetManager. setMgr is only consulted when info.IPSetMode is set.
+func (info *RoutingInfo) ConfigureWithHandle(handle NetlinkHandle, setMgr cidrSetManager, ip net.IP, mtu int, compat bool) error {
+	ipAddr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return fmt.Errorf("IP not compatible")
+	}
+	ipAddr = ipAddr.Unmap()
+
+	p, err := info.familyParamsFor(ipAddr)
+	if err != nil {
+		return err
+	}
+
+	link, err := findMasterInterface(handle, info.MasterIfMAC)
+	if err != nil {
+		return err
+	}
+
+	ingressRule := route.Rule{
+		Priority: p.ingressPriority,
+		To:       hostIPNet(ipAddr),
+		Table:    p.table,
+	}
+	if err := route.ReplaceRuleWithHandle(handle, ingressRule, p.family); err != nil {
+		return fmt.Errorf("unable to install ingress rule: %w", err)
+	}
+
+	egressRule := route.Rule{
+		Priority: p.egressPriority,
+		From:     hostIPNet(ipAddr),
+		Table:    p.table,
+	}
+	if err := route.ReplaceRuleWithHandle(handle, egressRule, p.family); err != nil {
+		return fmt.Errorf("unable to install egress rule: %w", err)
+	}
+
+	installedRoutes := []route.Route{{
+		Table:   p.table,
+		Device:  link.Attrs().Name,
+		MTU:     mtu,
+		Prefix:  *prefixToIPNet(defaultPrefix(p.family)),
+		Nexthop: gatewayPtr(p.gateway),
+	}}
+
+	trackedRules := []route.Rule{ingressRule, egressRule}
+
+	if info.IPSetMode && len(p.cidrs) > 0 {
+		// A prior, non-ipset Configure may have left per-CIDR routes behind
+		// in this table; drop them now that the ipset will take over
+		// matching them.
+		if err := migrateLegacyCIDRRoutes(handle, p.table, p.family); err != nil {
+			return fmt.Errorf("unable to migrate legacy CIDR routes: %w", err)
+		}
+
+		mark, mask := currentConfig.CIDRFwMark, currentConfig.CIDRFwMarkMask
+		if !probeFwMarkMaskSupport(handle, p.family) {
+			// The kernel can't match a masked fwmark; fall back to matching
+			// the mark exactly. This is still correct, it just can't share
+			// the rest of the mark's bits with another policy-routing user.
+			mask = 0xffffffff
+		}
+
+		setName := ipsetName(p.table)
+		if err := setMgr.ensure(setName, p.family, p.cidrs); err != nil {
+			return fmt.Errorf("unable to program CIDR ipset: %w", err)
+		}
+		if err := setMgr.markCIDRTraffic(setName, p.family, mark, mask); err != nil {
+			return fmt.Errorf("unable to install CIDR mark rule: %w", err)
+		}
+
+		fwmarkRule := route.Rule{
+			Priority: p.cidrFwmarkPriority,
+			Mark:     uint32(mark),
+			Mask:     uint32(mask),
+			Table:    p.table,
+		}
+		if err := route.ReplaceRuleWithHandle(handle, fwmarkRule, p.family); err != nil {
+			return fmt.Errorf("unable to install CIDR fwmark rule: %w", err)
+		}
+		trackedRules = append(trackedRules, fwmarkRule)
+	} else {
+		for _, cidr := range p.cidrs {
+			installedRoutes = append(installedRoutes, route.Route{
+				Table:   p.table,
+				Device:  link.Attrs().Name,
+				MTU:     mtu,
+				Prefix:  *prefixToIPNet(cidr),
+				Nexthop: gatewayPtr(p.gateway),
+			})
+		}
+	}
+
+	for _, rt := range installedRoutes {
+		if err := route.UpsertWithHandle(handle, rt); err != nil {
+			return fmt.Errorf("unable to install route for prefix %s: %w", rt.Prefix.String(), err)
+		}
+	}
+
+	if compat {
+		if err := route.UpsertWithHandle(handle, route.Route{
+			Table:   unix.RT_TABLE_MAIN,
+			Device:  link.Attrs().Name,
+			MTU:     mtu,
+			Prefix:  *prefixToIPNet(defaultPrefix(p.family)),
+			Nexthop: gatewayPtr(p.gateway),
+		}); err != nil {
+			return fmt.Errorf("unable to install compat default route: %w", err)
+		}
+	}
+
+	defaultReconciler.track(ipAddr, p.family, trackedRules, installedRoutes, handle)
+
+	return nil
+}
+
+// Delete removes the rules and routes previously installed by Configure for
+// ip. compat additionally removes the compatibility route installed in the
+// main routing table. It uses DefaultNetlinkHandle and the real
+// ipset/iptables-backed cidrSetManager; call DeleteWithHandle directly to
+// inject fakes of either (e.g. in unit tests).
+func Delete(ip netip.Addr, compat bool) error {
+	return DeleteWithHandle(DefaultNetlinkHandle, defaultCIDRSetManager, ip, compat)
+}
+
+// DeleteWithHandle is Delete with an injectable NetlinkHandle and
+// cidrSetManager. setMgr is only consulted if ip's endpoint turns out to
+// have been configured in IPSetMode, which Delete has no direct record of
+// and so detects the same way it detects everything else here: by listing
+// what Configure would have installed.
+func DeleteWithHandle(handle NetlinkHandle, setMgr cidrSetManager, ip netip.Addr, compat bool) error {
+	var family, ingressPriority, egressPriority, cidrFwmarkPriority int
+
+	switch {
+	case ip.Is4():
+		family = netlink.FAMILY_V4
+		ingressPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityIngress
+		egressPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgress
+		cidrFwmarkPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressCIDR
+	case ip.Is6():
+		family = netlink.FAMILY_V6
+		ingressPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityIngressV6
+		egressPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressV6
+		cidrFwmarkPriority = currentConfig.RulePriorityBase + linux_defaults.RulePriorityEgressCIDRV6
+	default:
+		return fmt.Errorf("IP not compatible")
+	}
+
+	rules, err := route.ListRulesWithHandle(handle, family, &route.Rule{Priority: ingressPriority})
+	if err != nil {
+		return fmt.Errorf("unable to list ingress rules: %w", err)
+	}
+
+	want := net.IP(ip.AsSlice())
+	var ingress *netlink.Rule
+	for i := range rules {
+		r := &rules[i]
+		if r.Dst == nil || !r.Dst.IP.Equal(want) {
+			continue
+		}
+		if ingress != nil {
+			return fmt.Errorf("IP %s matches more than one ingress rule", ip)
+		}
+		ingress = r
+	}
+	if ingress == nil {
+		return fmt.Errorf("unable to find ingress rule for IP %s", ip)
+	}
+
+	// Stop the reconciler from fighting us: it must not restore the
+	// rules/routes we are about to remove on purpose.
+	defaultReconciler.untrack(ip)
+
+	table := ingress.Table
+
+	routes, err := handle.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("unable to list routes in table %d: %w", table, err)
+	}
+	for i := range routes {
+		if err := handle.RouteDel(&routes[i]); err != nil {
+			return fmt.Errorf("unable to delete route %v: %w", routes[i], err)
+		}
+	}
+
+	if err := route.DeleteRuleWithHandle(handle, route.Rule{Priority: egressPriority, Table: table}, family); err != nil {
+		return fmt.Errorf("unable to delete egress rule: %w", err)
+	}
+
+	if err := handle.RuleDel(ingress); err != nil {
+		return fmt.Errorf("unable to delete ingress rule: %w", err)
+	}
+
+	// If this endpoint was ever configured with IPSetMode, tear down its
+	// fwmark rule, mark rule and ipset too. It was only ever configured that
+	// way if the fwmark rule Configure would have installed is actually
+	// there; a plain (non-ipset) endpoint never created one, so setMgr
+	// (which may itself be a fake, or even nil in tests that never exercise
+	// IPSetMode) is only touched when there is ipset/iptables state to
+	// remove.
+	mask := currentConfig.CIDRFwMarkMask
+	if !probeFwMarkMaskSupport(handle, family) {
+		mask = 0xffffffff
+	}
+	fwmarkRule := route.Rule{
+		Priority: cidrFwmarkPriority,
+		Mark:     uint32(currentConfig.CIDRFwMark),
+		Mask:     uint32(mask),
+		Table:    table,
+	}
+	if hadFwmarkRule(handle, family, fwmarkRule) {
+		_ = route.DeleteRuleWithHandle(handle, fwmarkRule, family)
+		if setMgr != nil {
+			setName := ipsetName(table)
+			_ = setMgr.unmarkCIDRTraffic(setName, family, currentConfig.CIDRFwMark, mask)
+			_ = setMgr.destroy(setName)
+		}
+	}
+
+	if compat {
+		if err := handle.RouteDel(&netlink.Route{
+			Table: unix.RT_TABLE_MAIN,
+			Dst:   prefixToIPNet(defaultPrefix(family)),
+		}); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("unable to delete compat default route: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyCIDRRoutes removes the per-CIDR routes that a pre-IPSetMode
+// Configure would have left in table, other than the table's default route,
+// which ipset/fwmark-based CIDR matching makes redundant. It is a no-op the
+// first time an endpoint is ever configured in IPSetMode, since there is
+// nothing to migrate away from.
+func migrateLegacyCIDRRoutes(handle NetlinkHandle, table int, family int) error {
+	routes, err := handle.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("unable to list routes in table %d: %w", table, err)
+	}
+
+	def := prefixToIPNet(defaultPrefix(family))
+	for i := range routes {
+		if sameIPNet(routes[i].Dst, def) {
+			continue
+		}
+		if err := handle.RouteDel(&routes[i]); err != nil {
+			return fmt.Errorf("unable to delete legacy CIDR route %v: %w", routes[i], err)
+		}
+	}
+	return nil
+}
+
+func sameIPNet(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// hadFwmarkRule reports whether a rule matching want (as installed for
+// IPSetMode by ConfigureWithHandle) is currently present at want's priority
+// and table.
+func hadFwmarkRule(handle NetlinkHandle, family int, want route.Rule) bool {
+	existing, err := route.ListRulesWithHandle(handle, family, &route.Rule{
+		Priority: want.Priority,
+		Table:    want.Table,
+	})
+	if err != nil {
+		return false
+	}
+	for i := range existing {
+		var existingMask uint32
+		if existing[i].Mask != nil {
+			existingMask = *existing[i].Mask
+		}
+		if existing[i].Mark == want.Mark && existingMask == want.Mask {
+			return true
+		}
+	}
+	return false
+}
+
+func findMasterInterface(handle NetlinkHandle, m mac.MAC) (netlink.Link, error) {
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list interfaces: %w", err)
+	}
+	for _, l := range links {
+		if l.Attrs().HardwareAddr.String() == m.String() {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find master interface with MAC %s", m)
+}
+
+func hostIPNet(addr netip.Addr) *net.IPNet {
+	bits := 32
+	if addr.Is6() {
+		bits = 128
+	}
+	return &net.IPNet{
+		IP:   net.IP(addr.AsSlice()),
+		Mask: net.CIDRMask(bits, bits),
+	}
+}
+
+func prefixToIPNet(p netip.Prefix) *net.IPNet {
+	bits := 32
+	if p.Addr().Is6() {
+		bits = 128
+	}
+	return &net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), bits),
+	}
+}
+
+func defaultPrefix(family int) netip.Prefix {
+	if family == netlink.FAMILY_V6 {
+		return netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	}
+	return netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+}
+
+func gatewayPtr(addr netip.Addr) *net.IP {
+	ip := net.IP(addr.AsSlice())
+	return &ip
+}
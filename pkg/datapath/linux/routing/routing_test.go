@@ -6,13 +6,19 @@
 package linuxrouting
 
 import (
+	"encoding/binary"
 	"net"
 	"net/netip"
+	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	. "gopkg.in/check.v1"
 
 	"github.com/cilium/cilium/pkg/datapath/linux/linux_defaults"
@@ -47,6 +53,132 @@ func (e *LinuxRoutingSuite) TestConfigure(c *C) {
 	})
 }
 
+func (e *LinuxRoutingSuite) TestConfigureDualStack(c *C) {
+	ipv4, ipv6, ri := getDualStackFakes(c)
+	masterMAC := ri.MasterIfMAC
+
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, masterMAC)
+		defer ifaceCleanup()
+
+		beforeRulesV4, beforeRoutesV4 := listRulesAndRoutes(c, netlink.FAMILY_V4)
+		beforeRulesV6, beforeRoutesV6 := listRulesAndRoutes(c, netlink.FAMILY_V6)
+
+		runConfigure(c, ri, ipv4, 1500)
+		runConfigure(c, ri, ipv6, 1500)
+
+		afterRulesV4, afterRoutesV4 := listRulesAndRoutes(c, netlink.FAMILY_V4)
+		afterRulesV6, afterRoutesV6 := listRulesAndRoutes(c, netlink.FAMILY_V6)
+		c.Assert(len(afterRulesV4), Not(Equals), len(beforeRulesV4))
+		c.Assert(len(afterRoutesV4), Not(Equals), len(beforeRoutesV4))
+		c.Assert(len(afterRulesV6), Not(Equals), len(beforeRulesV6))
+		c.Assert(len(afterRoutesV6), Not(Equals), len(beforeRoutesV6))
+
+		runDelete(c, ipv4)
+		runDelete(c, ipv6)
+
+		finalRulesV4, finalRoutesV4 := listRulesAndRoutes(c, netlink.FAMILY_V4)
+		finalRulesV6, finalRoutesV6 := listRulesAndRoutes(c, netlink.FAMILY_V6)
+		c.Assert(len(finalRulesV4), Equals, len(beforeRulesV4))
+		c.Assert(len(finalRoutesV4), Equals, len(beforeRoutesV4))
+		c.Assert(len(finalRulesV6), Equals, len(beforeRulesV6))
+		c.Assert(len(finalRoutesV6), Equals, len(beforeRoutesV6))
+	})
+}
+
+func (e *LinuxRoutingSuite) TestReconcilerRestoresDeletedIngressRule(c *C) {
+	fakeIP, ri := getFakes(c)
+	masterMAC := ri.MasterIfMAC
+
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, masterMAC)
+		defer ifaceCleanup()
+
+		runConfigure(c, ri, fakeIP, 1500)
+		defer runDelete(c, fakeIP)
+
+		rules, err := route.ListRules(netlink.FAMILY_V4, &route.Rule{
+			Priority: linux_defaults.RulePriorityIngress,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(len(rules), Not(Equals), 0)
+		c.Assert(netlink.RuleDel(&rules[0]), IsNil)
+
+		// Rule restoration has no change-notification API to react to (see
+		// reconcile.go), so it relies on the reconciler's poll interval;
+		// give it a few polls' worth of headroom rather than racing it.
+		deadline := time.Now().Add(5 * linux_defaults.RoutingRuleReconcilerPollInterval)
+		restored := false
+		for time.Now().Before(deadline) {
+			rules, err := route.ListRules(netlink.FAMILY_V4, &route.Rule{
+				Priority: linux_defaults.RulePriorityIngress,
+			})
+			c.Assert(err, IsNil)
+			if len(rules) != 0 {
+				restored = true
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		c.Assert(restored, Equals, true)
+	})
+}
+
+func (e *LinuxRoutingSuite) TestReconcilerRestoresDeletedDefaultRoute(c *C) {
+	fakeIP, ri := getFakes(c)
+	masterMAC := ri.MasterIfMAC
+
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, masterMAC)
+		defer ifaceCleanup()
+
+		runConfigure(c, ri, fakeIP, 1500)
+		defer runDelete(c, fakeIP)
+
+		rules, err := route.ListRules(netlink.FAMILY_V4, &route.Rule{
+			Priority: linux_defaults.RulePriorityEgress,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(len(rules), Not(Equals), 0)
+		table := rules[0].Table
+
+		defaultDst := prefixToIPNet(defaultPrefix(netlink.FAMILY_V4))
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			Table: table,
+		}, netlink.RT_FILTER_TABLE)
+		c.Assert(err, IsNil)
+		var defaultRoute *netlink.Route
+		for i := range routes {
+			if sameIPNet(routes[i].Dst, defaultDst) {
+				defaultRoute = &routes[i]
+				break
+			}
+		}
+		c.Assert(defaultRoute, NotNil)
+		c.Assert(netlink.RouteDel(defaultRoute), IsNil)
+
+		deadline := time.Now().Add(5 * time.Second)
+		restored := false
+		for time.Now().Before(deadline) {
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+				Table: table,
+			}, netlink.RT_FILTER_TABLE)
+			c.Assert(err, IsNil)
+			for i := range routes {
+				if sameIPNet(routes[i].Dst, defaultDst) {
+					restored = true
+					break
+				}
+			}
+			if restored {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		c.Assert(restored, Equals, true)
+	})
+}
+
 func (e *LinuxRoutingSuite) TestConfigureRoutewithIncompatibleIP(c *C) {
 	_, ri := getFakes(c)
 	ipv6 := netip.MustParseAddr("fd00::2").AsSlice()
@@ -130,6 +262,169 @@ func (e *LinuxRoutingSuite) TestDelete(c *C) {
 	}
 }
 
+// TestConfigureIPSetModeIsFasterWithManyCIDRs exercises the motivating case
+// for IPSetMode: an endpoint with a large number of CIDRs configures via one
+// ipset and one fwmark rule instead of one route per CIDR, which should be
+// substantially faster than the legacy per-CIDR path once the CIDR count
+// gets into the hundreds.
+func (e *LinuxRoutingSuite) TestConfigureIPSetModeIsFasterWithManyCIDRs(c *C) {
+	const numCIDRs = 1000
+
+	cidrs := make([]string, 0, numCIDRs)
+	for i := 0; i < numCIDRs; i++ {
+		cidrs = append(cidrs, netip.PrefixFrom(
+			netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}),
+			24,
+		).String())
+	}
+
+	fakeMAC, err := mac.ParseMAC("00:11:22:33:44:77")
+	c.Assert(err, IsNil)
+
+	legacyRI, err := parse("192.168.2.1", "", cidrs, fakeMAC.String(), "3", ipamOption.IPAMENI, true, false)
+	c.Assert(err, IsNil)
+
+	ipsetRI, err := parse("192.168.2.1", "", cidrs, fakeMAC.String(), "3", ipamOption.IPAMENI, true, true)
+	c.Assert(err, IsNil)
+
+	ip := netip.MustParseAddr("192.168.2.123")
+
+	var legacyElapsed, ipsetElapsed time.Duration
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, fakeMAC)
+		defer ifaceCleanup()
+
+		start := time.Now()
+		runConfigure(c, *legacyRI, ip, 1500)
+		legacyElapsed = time.Since(start)
+		runDelete(c, ip)
+	})
+
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, fakeMAC)
+		defer ifaceCleanup()
+
+		start := time.Now()
+		runConfigure(c, *ipsetRI, ip, 1500)
+		ipsetElapsed = time.Since(start)
+		runDelete(c, ip)
+	})
+
+	c.Logf("legacy per-CIDR: %s, ipset-backed: %s", legacyElapsed, ipsetElapsed)
+	c.Assert(ipsetElapsed < legacyElapsed, Equals, true)
+}
+
+// TestMarkCIDRTrafficAppliesToForwardedNotOutputTraffic guards against
+// markCIDRTraffic regressing onto mangle OUTPUT, which only ever sees
+// traffic a process in this network namespace originates itself. An
+// endpoint's egress traffic arrives over a wire and is forwarded through
+// the host, so it is only ever visible to mangle PREROUTING, never OUTPUT.
+// This test proves the distinction by injecting a frame at the link layer
+// of a veth pair, so the kernel processes it the same way it would traffic
+// entering from an endpoint's interface, rather than sending it from a
+// socket in this namespace, and checks that PREROUTING's packet counter
+// goes up in response while OUTPUT's does not.
+func (e *LinuxRoutingSuite) TestMarkCIDRTrafficAppliesToForwardedNotOutputTraffic(c *C) {
+	runFuncInNetNS(c, func() {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "cil-test-veth0"},
+			PeerName:  "cil-test-veth1",
+		}
+		c.Assert(netlink.LinkAdd(veth), IsNil)
+		defer netlink.LinkDel(veth)
+
+		peer, err := netlink.LinkByName("cil-test-veth1")
+		c.Assert(err, IsNil)
+
+		c.Assert(netlink.LinkSetUp(veth), IsNil)
+		c.Assert(netlink.LinkSetUp(peer), IsNil)
+
+		addr0, err := netlink.ParseAddr("10.99.0.1/30")
+		c.Assert(err, IsNil)
+		addr1, err := netlink.ParseAddr("10.99.0.2/30")
+		c.Assert(err, IsNil)
+		c.Assert(netlink.AddrAdd(veth, addr0), IsNil)
+		c.Assert(netlink.AddrAdd(peer, addr1), IsNil)
+
+		setMgr := shellCIDRSetManager{}
+		const setName = "cilium_test_preroute"
+		const mark, mask = 0x500, 0xf00
+		dst := netip.MustParsePrefix("10.99.0.2/32")
+
+		c.Assert(setMgr.ensure(setName, netlink.FAMILY_V4, []netip.Prefix{dst}), IsNil)
+		defer setMgr.destroy(setName)
+		c.Assert(setMgr.markCIDRTraffic(setName, netlink.FAMILY_V4, mark, mask), IsNil)
+		defer setMgr.unmarkCIDRTraffic(setName, netlink.FAMILY_V4, mark, mask)
+
+		beforePrerouting := mangleRulePacketCount(c, "PREROUTING")
+		beforeOutput := mangleRulePacketCount(c, "OUTPUT")
+
+		sendRawUDPFrame(c, veth.Attrs().Name, veth.Attrs().HardwareAddr, peer.Attrs().HardwareAddr,
+			net.ParseIP("10.99.0.1"), net.ParseIP("10.99.0.2"), 40000, 9999, []byte("probe"))
+
+		var afterPrerouting int
+		for i := 0; i < 50; i++ {
+			afterPrerouting = mangleRulePacketCount(c, "PREROUTING")
+			if afterPrerouting > beforePrerouting {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		c.Assert(afterPrerouting, Not(Equals), beforePrerouting,
+			Commentf("expected PREROUTING's mark rule to see the injected frame"))
+		c.Assert(mangleRulePacketCount(c, "OUTPUT"), Equals, beforeOutput)
+	})
+}
+
+// TestConfigureWithShiftedPriorityBaseAndCustomFwMark verifies that
+// SetRoutingConfig's RulePriorityBase and CIDRFwMark/CIDRFwMarkMask actually
+// take effect: rules end up at the shifted priorities, and the CIDR fwmark
+// rule uses the custom mark/mask rather than linux_defaults' hardcoded ones.
+func (e *LinuxRoutingSuite) TestConfigureWithShiftedPriorityBaseAndCustomFwMark(c *C) {
+	const base = 1000
+	const mark, mask = 0x4000, 0xff000
+
+	SetRoutingConfig(RoutingConfig{
+		RulePriorityBase: base,
+		CIDRFwMark:       mark,
+		CIDRFwMarkMask:   mask,
+	})
+	defer SetRoutingConfig(RoutingConfig{
+		CIDRFwMark:     linux_defaults.RoutingCIDRFwMark,
+		CIDRFwMarkMask: linux_defaults.RoutingCIDRFwMarkMask,
+	})
+
+	fakeMAC, err := mac.ParseMAC("00:11:22:33:44:88")
+	c.Assert(err, IsNil)
+	ri, err := parse("192.168.2.1", "", []string{"192.168.0.0/16"}, fakeMAC.String(), "4", ipamOption.IPAMENI, true, true)
+	c.Assert(err, IsNil)
+
+	ip := netip.MustParseAddr("192.168.2.123")
+
+	runFuncInNetNS(c, func() {
+		ifaceCleanup := createDummyDevice(c, fakeMAC)
+		defer ifaceCleanup()
+
+		runConfigure(c, *ri, ip, 1500)
+		defer runDelete(c, ip)
+
+		ingressRules, err := route.ListRules(netlink.FAMILY_V4, &route.Rule{
+			Priority: base + linux_defaults.RulePriorityIngress,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(len(ingressRules), Not(Equals), 0)
+
+		fwmarkRules, err := route.ListRules(netlink.FAMILY_V4, &route.Rule{
+			Priority: base + linux_defaults.RulePriorityEgressCIDR,
+			Mark:     mark,
+			Mask:     mask,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(len(fwmarkRules), Not(Equals), 0)
+	})
+}
+
 func runFuncInNetNS(c *C, run func()) {
 	// Source:
 	// https://github.com/vishvananda/netlink/blob/c79a4b7b40668c3f7867bf256b80b6b2dc65e58e/netns_test.go#L49
@@ -239,11 +534,13 @@ func getFakes(c *C) (netip.Addr, RoutingInfo) {
 
 	fakeRoutingInfo, err := parse(
 		fakeGateway.String(),
+		"",
 		[]string{fakeCIDR.String()},
 		fakeMAC.String(),
 		"1",
 		ipamOption.IPAMENI,
 		true,
+		false,
 	)
 	c.Assert(err, IsNil)
 	c.Assert(fakeRoutingInfo, NotNil)
@@ -253,6 +550,36 @@ func getFakes(c *C) (netip.Addr, RoutingInfo) {
 	return fakeIP, *fakeRoutingInfo
 }
 
+// getDualStackFakes returns a fake IPv4 endpoint IP, a fake IPv6 endpoint IP
+// and a dual-stack RoutingInfo as test harnesses.
+func getDualStackFakes(c *C) (netip.Addr, netip.Addr, RoutingInfo) {
+	fakeGatewayV4 := netip.MustParseAddr("192.168.2.1")
+	fakeCIDRV4 := netip.MustParsePrefix("192.168.0.0/16")
+	fakeGatewayV6 := netip.MustParseAddr("fd00::1")
+	fakeCIDRV6 := netip.MustParsePrefix("fd00::/64")
+	fakeMAC, err := mac.ParseMAC("00:11:22:33:44:66")
+	c.Assert(err, IsNil)
+	c.Assert(fakeMAC, NotNil)
+
+	fakeRoutingInfo, err := parse(
+		fakeGatewayV4.String(),
+		fakeGatewayV6.String(),
+		[]string{fakeCIDRV4.String(), fakeCIDRV6.String()},
+		fakeMAC.String(),
+		"2",
+		ipamOption.IPAMENI,
+		true,
+		false,
+	)
+	c.Assert(err, IsNil)
+	c.Assert(fakeRoutingInfo, NotNil)
+
+	fakeIPv4 := netip.MustParseAddr("192.168.2.124")
+	fakeIPv6 := netip.MustParseAddr("fd00::2")
+
+	return fakeIPv4, fakeIPv6, *fakeRoutingInfo
+}
+
 func linkExistsWithMAC(c *C, macAddr mac.MAC) bool {
 	links, err := netlink.LinkList()
 	c.Assert(err, IsNil)
@@ -265,3 +592,99 @@ func linkExistsWithMAC(c *C, macAddr mac.MAC) bool {
 
 	return false
 }
+
+// mangleRulePacketCount returns the packet counter of the first MARK rule
+// found in the mangle table's chain, or 0 if the chain has none.
+func mangleRulePacketCount(c *C, chain string) int {
+	out, err := exec.Command("iptables", "-t", "mangle", "-L", chain, "-v", "-n", "-x").CombinedOutput()
+	c.Assert(err, IsNil, Commentf("iptables -t mangle -L %s: %s", chain, out))
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, "MARK") {
+			continue
+		}
+		fields := strings.Fields(line)
+		n, err := strconv.Atoi(fields[0])
+		c.Assert(err, IsNil)
+		return n
+	}
+	return 0
+}
+
+// sendRawUDPFrame injects a complete Ethernet+IPv4+UDP frame onto ifaceName
+// at the link layer, so the kernel treats it as traffic newly arriving over
+// a wire (subject to PREROUTING) rather than traffic a local socket in this
+// namespace is sending (subject to OUTPUT).
+func sendRawUDPFrame(c *C, ifaceName string, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte) {
+	link, err := netlink.LinkByName(ifaceName)
+	c.Assert(err, IsNil)
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_IP)))
+	c.Assert(err, IsNil)
+	defer unix.Close(fd)
+
+	var hwAddr [8]byte
+	copy(hwAddr[:], dstMAC)
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_IP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+		Addr:     hwAddr,
+	}
+	c.Assert(unix.Bind(fd, sa), IsNil)
+	c.Assert(unix.Sendto(fd, udpFrame(srcMAC, dstMAC, srcIP, dstIP, srcPort, dstPort, payload), 0, sa), IsNil)
+}
+
+// udpFrame builds a complete little-endian-free (network byte order)
+// Ethernet+IPv4+UDP frame carrying payload from srcIP:srcPort to
+// dstIP:dstPort.
+func udpFrame(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+	ipLen := 20 + udpLen
+
+	frame := make([]byte, 14+ipLen)
+
+	copy(frame[0:6], dstMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], unix.ETH_P_IP)
+
+	ip := frame[14:]
+	ip[0] = 0x45 // version 4, 20-byte header
+	ip[1] = 0    // DSCP/ECN
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen))
+	binary.BigEndian.PutUint16(ip[4:6], 1) // identification
+	binary.BigEndian.PutUint16(ip[6:8], 0) // flags/fragment offset
+	ip[8] = 64                             // TTL
+	ip[9] = unix.IPPROTO_UDP
+	binary.BigEndian.PutUint16(ip[10:12], 0) // checksum, filled in below
+	copy(ip[12:16], srcIP.To4())
+	copy(ip[16:20], dstIP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip[0:20]))
+
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	binary.BigEndian.PutUint16(udp[6:8], 0) // checksum: optional for IPv4
+	copy(udp[8:], payload)
+
+	return frame
+}
+
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8&0xff00 | v>>8&0x00ff
+}
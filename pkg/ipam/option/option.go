@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+// Package option holds the well-known IPAM mode identifiers shared across
+// the agent and operator. It is deliberately free of other dependencies so
+// it can be imported from low-level datapath code.
+package option
+
+const (
+	// IPAMKubernetes is the value to select Kubernetes PodCIDR based IPAM.
+	IPAMKubernetes = "kubernetes"
+
+	// IPAMCRD is the value to select CRD-backed IPAM.
+	IPAMCRD = "crd"
+
+	// IPAMENI is the value to select AWS ENI IPAM.
+	IPAMENI = "eni"
+
+	// IPAMAzure is the value to select Azure IPAM.
+	IPAMAzure = "azure"
+
+	// IPAMAlibabaCloud is the value to select AlibabaCloud ENI IPAM.
+	IPAMAlibabaCloud = "alibabacloud"
+
+	// IPAMClusterPool is the value to select cluster pool based IPAM.
+	IPAMClusterPool = "cluster-pool"
+)
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mac
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// MAC address is a slice of bytes with methods to extract information from
+// them.
+type MAC net.HardwareAddr
+
+func (m MAC) String() string {
+	return net.HardwareAddr(m).String()
+}
+
+// Uint64 returns a MAC address as uint64 in network byte order.
+func (m MAC) Uint64() (asUint64 uint64) {
+	macLen := len(m)
+	if macLen != 6 && macLen != 8 {
+		return 0
+	}
+
+	buf := make([]byte, 8)
+	copy(buf[8-macLen:], m)
+	return binary.BigEndian.Uint64(buf)
+}
+
+// ParseMAC parses s as an IEEE 802 MAC-48 address.
+func ParseMAC(s string) (MAC, error) {
+	m, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %s: %w", s, err)
+	}
+	if len(m) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %s: not a MAC-48 address", s)
+	}
+
+	return MAC(m), nil
+}